@@ -1,6 +1,7 @@
 package httpretry
 
 import (
+	"context"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -13,10 +14,13 @@ var DefaultBackOff = func() backoff.BackOff {
 }
 
 // QuittableBackOff is a backoff.BackOff that halts future retries after Done()
-// gets called.
+// gets called.  It also halts retries once the attached context.Context (see
+// HttpGetter.SetContext) is canceled.
 type QuittableBackOff struct {
-	b      backoff.BackOff
-	IsDone bool
+	b            backoff.BackOff
+	IsDone       bool
+	ctx          context.Context
+	nextOverride time.Duration
 }
 
 func (b *QuittableBackOff) Done() {
@@ -28,9 +32,29 @@ func (b *QuittableBackOff) Reset() {
 	b.b.Reset()
 }
 
+// NextBackOff returns backoff.Stop once Done() has been called, or once the
+// attached context.Context is canceled.  If a server set a Retry-After value
+// on the last response (see HttpGetter.SetMaxRetryAfter), it overrides the
+// wrapped BackOff's interval once, and is then cleared.
 func (b *QuittableBackOff) NextBackOff() time.Duration {
 	if b.IsDone == true {
 		return backoff.Stop
 	}
+
+	if b.ctx != nil {
+		select {
+		case <-b.ctx.Done():
+			b.IsDone = true
+			return backoff.Stop
+		default:
+		}
+	}
+
+	if b.nextOverride > 0 {
+		d := b.nextOverride
+		b.nextOverride = 0
+		return d
+	}
+
 	return b.b.NextBackOff()
 }
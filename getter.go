@@ -1,6 +1,8 @@
 package httpretry
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -8,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"time"
 
@@ -16,6 +19,21 @@ import (
 
 type ResponseCallback func(*http.Response, error)
 type CloseCallback func(*HttpGetter)
+type AttemptCallback func(Attempt)
+
+// An Attempt summarizes the timing and outcome of a single HTTP attempt made
+// by connect(), as observed through an httptrace.ClientTrace that connect()
+// installs internally, whether or not SetClientTrace() was called.  It's
+// emitted to the callback set with OnAttempt().
+type Attempt struct {
+	Num        int
+	Start      time.Time
+	FirstByte  time.Time
+	End        time.Time
+	Reused     bool
+	Err        error
+	StatusCode int
+}
 
 // An HttpGetter is a wrapper around an HTTP Client that handles retries for
 // certain types of errors.  It implements the io.ReadCloser interface, and
@@ -23,15 +41,37 @@ type CloseCallback func(*HttpGetter)
 // be called before the first Read() is attempted.
 //
 // 4xx responses are considered errors due to a bad request by the client, and
-// will not be restarted.
+// will not be restarted, with the exception of 429 (Too Many Requests).
+//
+// Go errors, 429, and 5xx responses will be retried, even if the connection
+// times out, or drops before the entire response has been received.  Retries
+// are based on the Range header.  So, servers must advertise their
+// capability to fetch partial with the Accept-Ranges.
 //
-// Go errors and 5xx responses will be retried, even if the connection times
-// out, or drops before the entire response has been received.  Retries are
-// based on the Range header.  So, servers must advertise their capability to
-// fetch partial with the Accept-Ranges.
+// A 429 or 503 response carrying a Retry-After header overrides the next
+// backoff interval with the server-sent value, up to SetMaxRetryAfter().
 //
 // A successful response should have a status of 200 if no Range header was
 // sent, or 206.
+//
+// A context.Context can be attached with SetContext() to cancel an in
+// progress Do() or Read(), including any time spent sleeping between
+// retries.
+//
+// Retry requests are validated against the ETag or Last-Modified value of
+// the first response with an If-Range header.  If the underlying resource
+// changed in the meantime, the server will ignore the Range header and send
+// a fresh 200 response instead of the expected 206.  By default, this
+// triggers a transparent restart from offset 0.  See SetOnResourceChanged()
+// to opt into a harder failure mode instead.
+//
+// A httptrace.ClientTrace set with SetClientTrace() is installed on every
+// attempt, and OnAttempt() can be used to receive a compact summary of each
+// attempt's timing without writing trace hooks by hand.
+//
+// EnableCompression() requests a gzip-encoded response and transparently
+// decodes it.  See EnableCompression for how a dropped connection is
+// handled mid-decode.
 type HttpGetter struct {
 	Request       *http.Request
 	Body          io.ReadCloser
@@ -45,8 +85,37 @@ type HttpGetter struct {
 	b             *QuittableBackOff
 	rcb           ResponseCallback
 	ccb           CloseCallback
+	rccb          func(*HttpGetter)
 	next          time.Duration
 	closed        bool
+	ctx           context.Context
+	etag          string
+	lastModified  string
+	maxRetryAfter time.Duration
+	ctrace        *httptrace.ClientTrace
+	acb           AttemptCallback
+
+	// compression, gzipActive, compressedBytesRead, gzipSrc, and gzr back
+	// EnableCompression().  gzipSrc is the counting reader that sits
+	// between the wire and gzr, the *gzip.Reader that actually decodes;
+	// compressedBytesRead is fed from gzipSrc and exposed by
+	// CompressedBytesRead().  See EnableCompression and
+	// SetOnGzipInterrupted for how a dropped connection mid-decode is
+	// handled.
+	compression         bool
+	gzipActive          bool
+	compressedBytesRead int64
+	gzipSrc             *gzipSource
+	gzr                 *gzip.Reader
+	gccb                func(*HttpGetter)
+
+	// isPart, partRangeStart, and partRangeEnd are set by ParallelGetter to
+	// drive a single byte range of a multi-part download.  Unlike the
+	// whole-resource case above, the Range header is present from the very
+	// first request, and a 206 is expected throughout the part's lifetime.
+	isPart         bool
+	partRangeStart int64
+	partRangeEnd   int64
 }
 
 // Getter initializes the *HttpGetter.
@@ -54,8 +123,16 @@ func Getter(req *http.Request) *HttpGetter {
 	return &HttpGetter{Request: req}
 }
 
+// GetterWithContext initializes the *HttpGetter with a context.Context, as if
+// SetContext(ctx) were called on it immediately.
+func GetterWithContext(ctx context.Context, req *http.Request) *HttpGetter {
+	g := Getter(req)
+	g.SetContext(ctx)
+	return g
+}
+
 // Do returns the status code and response header for the first successful
-// response.  Any Go errors or 5xx status codes will trigger retries.
+// response.  Any Go errors, 429, or 5xx status codes will trigger retries.
 func (g *HttpGetter) Do() (int, http.Header) {
 	if g.b == nil {
 		g.SetBackOff(nil)
@@ -77,10 +154,45 @@ func (g *HttpGetter) Do() (int, http.Header) {
 		g.OnClose(nil)
 	}
 
-	backoff.Retry(g.connect, g.b)
+	if g.maxRetryAfter == 0 {
+		g.SetMaxRetryAfter(0)
+	}
+
+	if g.acb == nil {
+		g.OnAttempt(nil)
+	}
+
+	g.b.ctx = g.ctx
+
+	g.b.Reset()
+	for g.connect() != nil {
+		next := g.b.NextBackOff()
+		if next == backoff.Stop {
+			break
+		}
+		if g.ctx == nil {
+			time.Sleep(next)
+			continue
+		}
+		select {
+		case <-g.ctx.Done():
+		case <-time.After(next):
+		}
+	}
 	return g.StatusCode, g.Header
 }
 
+// SetContext attaches a context.Context to this *HttpGetter.  The context is
+// attached to every outgoing request with Request.WithContext(), and its
+// cancellation or deadline aborts any pending backoff sleep in Read(),
+// causing Read() to return ctx.Err().
+func (g *HttpGetter) SetContext(ctx context.Context) {
+	g.ctx = ctx
+	if g.b != nil {
+		g.b.ctx = ctx
+	}
+}
+
 // SetBackOff sets the backoff configuration for this *HttpGetter.  If nil,
 // DefaultBackoff() is called instead.
 func (g *HttpGetter) SetBackOff(b backoff.BackOff) {
@@ -128,6 +240,86 @@ func (g *HttpGetter) OnClose(f CloseCallback) {
 	}
 }
 
+// SetMaxRetryAfter caps the delay this *HttpGetter will honor from a
+// server-sent Retry-After header on a 429 or 503 response.  If d is 0, a
+// default of 5 minutes is used.
+func (g *HttpGetter) SetMaxRetryAfter(d time.Duration) {
+	if d == 0 {
+		d = defaultMaxRetryAfter
+	}
+	g.maxRetryAfter = d
+}
+
+// SetOnResourceChanged sets a function to be called when a retried request's
+// Range is ignored by the server because the underlying resource no longer
+// matches the ETag or Last-Modified value captured from the first response.
+//
+// By default (no callback set), this is handled with a transparent restart:
+// BytesRead and the hasher are reset, and the getter keeps streaming the
+// fresh response from offset 0.  Setting a callback here opts into a harder
+// failure mode instead: the callback is invoked, further retries are
+// stopped, and Read() returns ErrResourceChanged so the caller can
+// decide how to recover, e.g. truncating a partially written destination.
+func (g *HttpGetter) SetOnResourceChanged(f func(*HttpGetter)) {
+	g.rccb = f
+}
+
+// EnableCompression, when enabled, sets Accept-Encoding: gzip on requests
+// and transparently decodes a gzip-encoded response.  It defaults to off,
+// preserving the historical behavior of streaming the response body
+// unmodified.  BytesRead and the hasher reflect decoded bytes, while
+// CompressedBytesRead() reports the raw wire bytes consumed so far.
+//
+// A gzip stream can't be resumed part way through decoding, so a dropped
+// connection while decoding one restarts the whole object from offset 0,
+// the same way an ignored If-Range does, rather than attempting a Range
+// request against the compressed bytes.  See SetOnGzipInterrupted for what
+// happens if decoded bytes had already been delivered before the drop.
+func (g *HttpGetter) EnableCompression(enabled bool) {
+	g.compression = enabled
+}
+
+// CompressedBytesRead gets the number of raw, still gzip-encoded bytes
+// consumed from the wire so far, for observability.  It's fed from the
+// counting reader that sits beneath the gzip.Reader, and only ever advances
+// while a compressed response is being decoded.
+func (g *HttpGetter) CompressedBytesRead() int64 {
+	return g.compressedBytesRead
+}
+
+// SetOnGzipInterrupted sets a function to be called when a gzip-encoded
+// response drops mid-decode after Read() had already delivered some of its
+// decoded bytes to the caller.  Unlike SetOnResourceChanged, there's no
+// safe transparent restart in this case: bytes already delivered can't be
+// un-sent, and re-fetching the whole object would duplicate them.  So the
+// callback is invoked if set, retries are stopped, and Read() returns
+// ErrGzipInterrupted regardless of whether a callback was set, so the
+// caller can decide how to recover, e.g. truncating a partially written
+// destination. If no decoded bytes had reached the caller yet, the getter
+// instead restarts transparently, as if this were the first attempt.
+func (g *HttpGetter) SetOnGzipInterrupted(f func(*HttpGetter)) {
+	g.gccb = f
+}
+
+// SetClientTrace attaches a httptrace.ClientTrace to every attempt this
+// *HttpGetter makes, via httptrace.WithClientTrace(req.Context(), t).  It
+// composes with the trace this *HttpGetter installs internally to drive
+// OnAttempt(), so both sets of hooks fire for every attempt.
+func (g *HttpGetter) SetClientTrace(t *httptrace.ClientTrace) {
+	g.ctrace = t
+}
+
+// OnAttempt sets a function to be called after every attempt this
+// *HttpGetter makes, with a summary of its timing and outcome.  This saves
+// callers from reimplementing that bookkeeping with their own
+// httptrace.ClientTrace.
+func (g *HttpGetter) OnAttempt(f AttemptCallback) {
+	if f == nil {
+		f = acb
+	}
+	g.acb = f
+}
+
 // Read implements the io.Reader interface.  If a non EOF error is returned,
 // the HTTP body is closed, and no Go error is returned so that Read() can
 // get called again.  The backoff retry logic is used to re-establish HTTP
@@ -140,7 +332,15 @@ func (g *HttpGetter) Read(b []byte) (int, error) {
 				return 0, err
 			}
 
-			time.Sleep(g.next)
+			if g.ctx != nil {
+				select {
+				case <-g.ctx.Done():
+					return 0, g.ctx.Err()
+				case <-time.After(g.next):
+				}
+			} else {
+				time.Sleep(g.next)
+			}
 
 			return 0, nil
 		} else {
@@ -148,7 +348,40 @@ func (g *HttpGetter) Read(b []byte) (int, error) {
 		}
 	}
 
-	read, err := g.Body.Read(b)
+	var read int
+	var err error
+	if g.gzipActive {
+		read, err = g.gzr.Read(b)
+	} else {
+		read, err = g.Body.Read(b)
+	}
+
+	if err != nil && err != io.EOF && g.gzipActive {
+		// See EnableCompression and SetOnGzipInterrupted: a restart is
+		// only safe if nothing from this decode has reached the caller
+		// yet.  Any bytes decoded by *this* Read() are discarded either
+		// way, since they were never returned.
+		delivered := g.BytesRead > 0
+
+		g.reset()
+		g.gzipActive = false
+		g.gzr = nil
+		g.gzipSrc = nil
+		g.compressedBytesRead = 0
+
+		if delivered {
+			if g.gccb != nil {
+				g.gccb(g)
+			}
+			g.b.Done()
+			return 0, ErrGzipInterrupted
+		}
+
+		g.BytesRead = 0
+		g.hasher.Reset()
+		return 0, nil
+	}
+
 	if read > 0 {
 		g.BytesRead += int64(read)
 		g.hasher.Write(b[:read])
@@ -200,18 +433,80 @@ func (g *HttpGetter) connect() error {
 	// Non 5xx statuses or the lack of an Accept-Ranges response header will
 	// prevent future retries.
 	if g.b.IsDone {
+		if g.ctx != nil {
+			if err := g.ctx.Err(); err != nil {
+				return err
+			}
+		}
 		return io.EOF
 	}
 
+	if g.ctx != nil {
+		select {
+		case <-g.ctx.Done():
+			g.b.Done()
+			return g.ctx.Err()
+		default:
+		}
+	}
+
 	expectedStatus := 200
+	rangeStart, rangeEnd := g.BytesRead, g.ContentLength-1
+	setRange := g.BytesRead > 0 && g.ContentLength > 0
 
-	if g.BytesRead > 0 && g.ContentLength > 0 {
+	if g.isPart {
+		rangeStart, rangeEnd = g.partRangeStart+g.BytesRead, g.partRangeEnd
+		setRange = true
+	}
+
+	if setRange {
 		expectedStatus = 206
-		g.Request.Header.Set(rangeHeader, fmt.Sprintf(rangeFormat, g.BytesRead, g.ContentLength-1))
+		g.Request.Header.Set(rangeHeader, fmt.Sprintf(rangeFormat, rangeStart, rangeEnd))
+
+		if g.etag != "" {
+			g.Request.Header.Set(ifRangeHeader, g.etag)
+		} else if g.lastModified != "" {
+			g.Request.Header.Set(ifRangeHeader, g.lastModified)
+		}
 	}
 
-	res, err := g.client.Do(g.Request)
+	if g.compression && !g.isPart {
+		g.Request.Header.Set(acceptEncodingHeader, gzipEncoding)
+	}
+
+	req := g.Request
+	if g.ctx != nil {
+		req = req.WithContext(g.ctx)
+	}
+
+	var at Attempt
+	at.Start = time.Now()
+
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			at.Reused = info.Reused
+		},
+		GotFirstResponseByte: func() {
+			at.FirstByte = time.Now()
+		},
+	}
+	traceCtx := httptrace.WithClientTrace(req.Context(), trace)
+	if g.ctrace != nil {
+		traceCtx = httptrace.WithClientTrace(traceCtx, g.ctrace)
+	}
+	req = req.WithContext(traceCtx)
+
+	res, err := g.client.Do(req)
 	g.Attempts += 1
+	at.End = time.Now()
+
+	at.Num = g.Attempts
+	at.Err = err
+	if res != nil {
+		at.StatusCode = res.StatusCode
+	}
+	g.acb(at)
+
 	g.rcb(res, err)
 	if err != nil {
 		return err
@@ -226,17 +521,34 @@ func (g *HttpGetter) connect() error {
 	// successful response
 	if res.StatusCode == expectedStatus {
 		g.setResponse(res)
+		if err := g.syncGzip(res); err != nil {
+			return err
+		}
+	} else if !g.isPart && expectedStatus == 206 && res.StatusCode == 200 {
+		// The server ignored If-Range/Range and sent a fresh, full body
+		// instead of a 206, meaning the resource changed since the first
+		// response.  Keep g.Body as-is and restart streaming from offset 0.
+		return g.resourceChanged(res)
 	} else {
 		// if we're looking for a partial response, just close and retry later.
 		if expectedStatus == 206 {
 			g.reset()
 		}
 
-		// if it's not a 5xx, stop retries.
-		if res.StatusCode > 0 && (res.StatusCode < 500 || res.StatusCode > 599) {
+		retryable := res.StatusCode == 429 || (res.StatusCode >= 500 && res.StatusCode <= 599)
+
+		// if it's not a 429 or 5xx, stop retries.
+		if res.StatusCode > 0 && !retryable {
 			g.setResponse(res)
 			g.b.Done()
 		} else {
+			if d, ok := parseRetryAfter(res.Header, time.Now()); ok {
+				if d > g.maxRetryAfter {
+					d = g.maxRetryAfter
+				}
+				g.b.nextOverride = d
+			}
+
 			// Drain the body, necessary for go <= 1.3
 			io.Copy(ioutil.Discard, res.Body)
 			res.Body.Close()
@@ -257,24 +569,145 @@ func (g *HttpGetter) setResponse(res *http.Response) {
 
 	g.StatusCode = res.StatusCode
 	g.Header = res.Header
-	if v := g.Header.Get(acceptHeader); v != acceptValue {
-		g.b.Done()
+
+	// Accept-Ranges isn't guaranteed on every 206 by RFC 7233, only on the
+	// original resource representation, so a part (whose range support was
+	// already confirmed by ParallelGetter's HEAD probe) doesn't stop
+	// retrying just because one particular response omitted it.
+	if !g.isPart {
+		if v := g.Header.Get(acceptHeader); v != acceptValue {
+			g.b.Done()
+		}
 	}
 
+	g.etag = g.Header.Get(etagHeader)
+	g.lastModified = g.Header.Get(lastModHeader)
+
 	i, _ := strconv.ParseInt(res.Header.Get(clenHeader), 10, 0)
 	g.ContentLength = i
 }
 
+// syncGzip starts decoding a gzip-encoded response.  It's called for every
+// response with the expected status, 200 or 206, and does nothing unless
+// compression is enabled and the response is gzip-encoded.  See
+// EnableCompression for why a dropped gzip response is not resumed with a
+// Range of the compressed bytes.
+func (g *HttpGetter) syncGzip(res *http.Response) error {
+	if !g.compression || g.isPart {
+		return nil
+	}
+
+	if res.Header.Get(contentEncodingHeader) != gzipEncoding {
+		g.gzipActive = false
+		g.gzr = nil
+		g.gzipSrc = nil
+		return nil
+	}
+
+	g.compressedBytesRead = 0
+	g.gzipSrc = &gzipSource{r: res.Body, n: &g.compressedBytesRead}
+
+	gzr, err := gzip.NewReader(g.gzipSrc)
+	if err != nil {
+		return err
+	}
+
+	g.gzr = gzr
+	g.gzipActive = true
+	return nil
+}
+
+// A gzipSource sits between the wire and a *gzip.Reader, counting the raw
+// bytes a gzip decode has consumed so far, for compressedBytesRead.
+type gzipSource struct {
+	r io.Reader
+	n *int64
+}
+
+func (s *gzipSource) Read(b []byte) (int, error) {
+	read, err := s.r.Read(b)
+	if read > 0 {
+		*s.n += int64(read)
+	}
+	return read, err
+}
+
+// resourceChanged handles a retry response whose If-Range validator no
+// longer matched, so the server sent a fresh full body instead of a 206.
+// By default this is a transparent restart.  If SetOnResourceChanged() was
+// called, the callback is invoked and ErrResourceChanged is returned instead.
+//
+// Either way, the ETag, Last-Modified, and Content-Length captured from the
+// original response are stale: they describe the resource version that no
+// longer exists.  They're re-synced from res, the response that revealed
+// the change, so a later retry validates against and ranges over the new
+// resource instead of the one that's gone.
+func (g *HttpGetter) resourceChanged(res *http.Response) error {
+	g.Header = res.Header
+	g.etag = g.Header.Get(etagHeader)
+	g.lastModified = g.Header.Get(lastModHeader)
+
+	i, _ := strconv.ParseInt(res.Header.Get(clenHeader), 10, 0)
+	g.ContentLength = i
+
+	if g.rccb != nil {
+		g.rccb(g)
+		g.b.Done()
+		return ErrResourceChanged
+	}
+
+	g.BytesRead = 0
+	g.hasher.Reset()
+	return nil
+}
+
+// parseRetryAfter parses a Retry-After response header, either as
+// delta-seconds or an HTTP-date, per RFC 7231 section 7.1.3.  The second
+// return value is false if the header is absent or unparseable.
+func parseRetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get(retryAfterHeader)
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+	}
+
+	return 0, false
+}
+
 var (
-	rcb           = func(r *http.Response, e error) {}
-	ccb           = func(g *HttpGetter) {}
-	EmptyResponse = fmt.Errorf("Received response with status code 0")
+	rcb                = func(r *http.Response, e error) {}
+	ccb                = func(g *HttpGetter) {}
+	acb                = func(a Attempt) {}
+	EmptyResponse      = fmt.Errorf("Received response with status code 0")
+	ErrResourceChanged = fmt.Errorf("Resource changed since the first response")
+	ErrGzipInterrupted = fmt.Errorf("Gzip stream interrupted after delivering decoded bytes")
 )
 
 const (
-	acceptHeader = "Accept-Ranges"
-	acceptValue  = "bytes"
-	rangeHeader  = "Range"
-	rangeFormat  = "bytes=%d-%d"
-	clenHeader   = "Content-Length"
+	acceptHeader          = "Accept-Ranges"
+	acceptValue           = "bytes"
+	rangeHeader           = "Range"
+	rangeFormat           = "bytes=%d-%d"
+	clenHeader            = "Content-Length"
+	etagHeader            = "ETag"
+	lastModHeader         = "Last-Modified"
+	ifRangeHeader         = "If-Range"
+	retryAfterHeader      = "Retry-After"
+	contentEncodingHeader = "Content-Encoding"
+	acceptEncodingHeader  = "Accept-Encoding"
+	gzipEncoding          = "gzip"
+
+	defaultMaxRetryAfter = 5 * time.Minute
 )
@@ -2,10 +2,13 @@ package httpretry
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"strconv"
 	"strings"
 	"sync"
@@ -208,6 +211,11 @@ func TestSkipRetryWith400(t *testing.T) {
 	}
 
 	for status = 400; status < 500; status++ {
+		if status == 429 {
+			// 429 is retried like a 5xx; see TestRetryOn429.
+			continue
+		}
+
 		reader := testGetter(t, req)
 		code, head := reader.Do()
 
@@ -237,6 +245,603 @@ func TestSkipRetryWith400(t *testing.T) {
 	}
 }
 
+func TestContextCancellation(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Length", "4")
+		w.WriteHeader(500)
+		w.Write([]byte("BOOM"))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	reader := testGetter(t, req)
+	reader.SetContext(ctx)
+
+	code, _ := reader.Do()
+	if code != 0 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if _, err := reader.Read(make([]byte, 10)); err != ctx.Err() {
+		t.Errorf("Expected context error, got: %v", err)
+	}
+
+	reader.Close()
+}
+
+func TestResourceChangedRestart(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("If-Range"); v != "v1" {
+			t.Errorf("Expected If-Range v1, got %q", v)
+		}
+
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+		head.Set("ETag", "v2")
+		head.Set("Content-Length", "10")
+		w.WriteHeader(200)
+		w.Write([]byte("abcdefghij"))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a getter that already read half of an earlier version of the
+	// resource before a dropped connection forced a retry.
+	reader := testGetter(t, req)
+	reader.SetHash(nil)
+	reader.SetClient(nil)
+	reader.OnResponse(nil)
+	reader.OnClose(nil)
+	reader.OnAttempt(nil)
+	reader.StatusCode = 200
+	reader.ContentLength = 10
+	reader.BytesRead = 5
+	reader.etag = "v1"
+
+	if err := reader.connect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+
+	if reader.BytesRead != 0 {
+		t.Errorf("Expected BytesRead to reset to 0, got %d", reader.BytesRead)
+	}
+
+	buf := &bytes.Buffer{}
+	written, err := io.Copy(buf, reader)
+	if err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if written != 10 {
+		t.Errorf("Wrote %d", written)
+	}
+
+	if b := buf.String(); b != "abcdefghij" {
+		t.Errorf("Got %s", b)
+	}
+
+	reader.Close()
+}
+
+func TestResourceChangedWithCallback(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Length", "10")
+		head.Set("ETag", "v2")
+		w.WriteHeader(200)
+		w.Write([]byte("abcdefghij"))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testGetter(t, req)
+	reader.SetHash(nil)
+	reader.SetClient(nil)
+	reader.OnResponse(nil)
+	reader.OnClose(nil)
+	reader.OnAttempt(nil)
+	reader.StatusCode = 200
+	reader.ContentLength = 10
+	reader.BytesRead = 5
+	reader.etag = "v1"
+
+	called := false
+	reader.SetOnResourceChanged(func(g *HttpGetter) {
+		called = true
+	})
+
+	if err := reader.connect(); err != ErrResourceChanged {
+		t.Fatalf("Expected ErrResourceChanged, got: %v", err)
+	}
+
+	if !called {
+		t.Errorf("Expected the resource changed callback to be called")
+	}
+
+	if reader.BytesRead != 5 {
+		t.Errorf("Expected BytesRead to be left alone, got %d", reader.BytesRead)
+	}
+
+	reader.Close()
+}
+
+func TestResourceChangedResyncsMetadata(t *testing.T) {
+	t.Parallel()
+
+	numRequests := 0
+	mutex := &sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numRequests++
+		n := numRequests
+		mutex.Unlock()
+
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+
+		switch n {
+		case 1:
+			if v := r.Header.Get("If-Range"); v != "v1" {
+				t.Errorf("Expected If-Range v1, got %q", v)
+			}
+			if v := r.Header.Get("Range"); v != "bytes=5-9" {
+				t.Errorf("Expected Range bytes=5-9, got %q", v)
+			}
+
+			// The resource changed: server ignores Range/If-Range and sends
+			// a fresh, full v2 body instead of the expected 206.
+			head.Set("ETag", "v2")
+			head.Set("Content-Length", "20")
+			w.WriteHeader(200)
+			w.Write([]byte("ABCDEFGHIJKLMNOPQRST"))
+		case 2:
+			// A second drop mid-v2-stream must validate and range against
+			// v2, the resource that's actually live, not the stale v1
+			// metadata from the first response.
+			if v := r.Header.Get("If-Range"); v != "v2" {
+				t.Errorf("Expected If-Range v2 (re-synced from the v2 response), got %q", v)
+			}
+			if v := r.Header.Get("Range"); v != "bytes=15-19" {
+				t.Errorf("Expected Range bytes=15-19 (re-synced Content-Length), got %q", v)
+			}
+
+			head.Set("ETag", "v2")
+			head.Set("Content-Range", "bytes 15-19/20")
+			head.Set("Content-Length", "5")
+			w.WriteHeader(206)
+			w.Write([]byte("PQRST"))
+		default:
+			t.Fatalf("Unexpected request %d", n)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a getter that already read half of v1 before a dropped
+	// connection forced a retry, same setup as TestResourceChangedRestart.
+	reader := testGetter(t, req)
+	reader.SetHash(nil)
+	reader.SetClient(nil)
+	reader.OnResponse(nil)
+	reader.OnClose(nil)
+	reader.OnAttempt(nil)
+	reader.StatusCode = 200
+	reader.ContentLength = 10
+	reader.BytesRead = 5
+	reader.etag = "v1"
+
+	if err := reader.connect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+
+	if reader.etag != "v2" {
+		t.Errorf("Expected etag to re-sync to v2, got %q", reader.etag)
+	}
+
+	if reader.ContentLength != 20 {
+		t.Errorf("Expected ContentLength to re-sync to 20, got %d", reader.ContentLength)
+	}
+
+	// simulate a second drop, now 15 bytes into v2, and confirm the retry
+	// validates and ranges against v2's metadata, not v1's.
+	reader.reset()
+	reader.BytesRead = 15
+
+	if err := reader.connect(); err != nil {
+		t.Fatalf("connect error: %s", err)
+	}
+
+	if numRequests != 2 {
+		t.Errorf("Expected 2 requests, got %d", numRequests)
+	}
+
+	reader.Close()
+}
+
+func TestRetryOn429(t *testing.T) {
+	t.Parallel()
+	numRequests := 0
+	mutex := &sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numRequests++
+		n := numRequests
+		mutex.Unlock()
+
+		if n == 1 {
+			w.Header().Set("Retry-After", "0")
+			writeTestData(w, 429, "slow down")
+			return
+		}
+
+		writeTestData(w, 200, "ok")
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testGetter(t, req)
+	code, _ := reader.Do()
+
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if numRequests < 2 {
+		t.Errorf("Only made %d request(s)?", numRequests)
+	}
+
+	reader.Close()
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	h := http.Header{}
+	if _, ok := parseRetryAfter(h, now); ok {
+		t.Errorf("Expected no Retry-After value")
+	}
+
+	h.Set("Retry-After", "120")
+	d, ok := parseRetryAfter(h, now)
+	if !ok || d != 120*time.Second {
+		t.Errorf("Expected 120s, got %s (ok: %v)", d, ok)
+	}
+
+	h.Set("Retry-After", now.Add(90*time.Second).Format(http.TimeFormat))
+	d, ok = parseRetryAfter(h, now)
+	if !ok || d != 90*time.Second {
+		t.Errorf("Expected 90s, got %s (ok: %v)", d, ok)
+	}
+
+	h.Set("Retry-After", "not a valid value")
+	if _, ok := parseRetryAfter(h, now); ok {
+		t.Errorf("Expected unparseable Retry-After to be ignored")
+	}
+}
+
+func TestGzipDecoding(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("hello world, this is compressible. "), 50)
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	gzw.Write(content)
+	gzw.Close()
+	gz := compressed.Bytes()
+	split := len(gz) / 2
+
+	numRequests := 0
+	mutex := &sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		n := numRequests
+		numRequests++
+		mutex.Unlock()
+
+		if enc := r.Header.Get("Accept-Encoding"); enc != "gzip" {
+			t.Errorf("Expected Accept-Encoding: gzip, got %q", enc)
+		}
+		if v := r.Header.Get("Range"); v != "" {
+			t.Errorf("Expected no Range header for a gzip retry, got %q", v)
+		}
+
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+		head.Set("Content-Encoding", "gzip")
+		head.Set("Content-Length", strconv.Itoa(len(gz)))
+		w.WriteHeader(200)
+
+		if n == 0 {
+			// A connection dropped partway through the gzip stream: the
+			// decoder can't resume, so the getter must restart the whole
+			// object from scratch on the next attempt.
+			w.Write(gz[:split])
+			return
+		}
+
+		w.Write(gz)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testGetter(t, req)
+	reader.EnableCompression(true)
+
+	code, head := reader.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if enc := head.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Unexpected Content-Encoding: %s", enc)
+	}
+
+	buf := &bytes.Buffer{}
+	written, err := io.Copy(buf, reader)
+	if err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if written != int64(len(content)) {
+		t.Errorf("Wrote %d, expected %d", written, len(content))
+	}
+
+	if b := buf.String(); b != string(content) {
+		t.Errorf("Decoded content mismatch")
+	}
+
+	if numRequests < 2 {
+		t.Errorf("Only made %d request(s)?", numRequests)
+	}
+
+	if n := reader.CompressedBytesRead(); n != int64(len(gz)) {
+		t.Errorf("Expected CompressedBytesRead %d, got %d", len(gz), n)
+	}
+
+	reader.Close()
+}
+
+func TestGzipInterruptedAfterDelivery(t *testing.T) {
+	t.Parallel()
+
+	content := bytes.Repeat([]byte("hello world, this is compressible. "), 50)
+
+	var compressed bytes.Buffer
+	gzw := gzip.NewWriter(&compressed)
+	gzw.Write(content)
+	gzw.Close()
+	gz := compressed.Bytes()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+		head.Set("Content-Encoding", "gzip")
+		head.Set("Content-Length", strconv.Itoa(len(gz)))
+		w.WriteHeader(200)
+
+		// Drop the connection partway through the gzip stream, same as
+		// TestGzipDecoding, but this time the getter already believes it
+		// delivered decoded bytes from an earlier attempt.
+		w.Write(gz[:len(gz)/2])
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testGetter(t, req)
+	reader.EnableCompression(true)
+
+	called := false
+	reader.SetOnGzipInterrupted(func(g *HttpGetter) {
+		called = true
+	})
+
+	if code, _ := reader.Do(); code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	// Simulate decoded bytes having already reached the caller before this
+	// Read() hits the truncated stream.
+	reader.BytesRead = 1
+
+	if _, err := reader.Read(make([]byte, len(content))); err != ErrGzipInterrupted {
+		t.Fatalf("Expected ErrGzipInterrupted, got: %v", err)
+	}
+
+	if !called {
+		t.Errorf("Expected SetOnGzipInterrupted callback to be called")
+	}
+
+	reader.Close()
+}
+
+func TestGzipPassthroughWhenNotEncoded(t *testing.T) {
+	t.Parallel()
+	content := []byte("plain text, never compressed")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// This server ignores Accept-Encoding: gzip entirely.
+		head := w.Header()
+		head.Set("Content-Type", "text/plain")
+		head.Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(200)
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := testGetter(t, req)
+	reader.EnableCompression(true)
+
+	code, _ := reader.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(buf, reader); err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if b := buf.String(); b != string(content) {
+		t.Errorf("Expected unmodified passthrough, got %q", b)
+	}
+
+	if reader.gzipActive {
+		t.Errorf("Expected gzipActive to stay false for a non-gzip response")
+	}
+
+	reader.Close()
+}
+
+func TestOnAttempt(t *testing.T) {
+	t.Parallel()
+	numRequests := 0
+	mutex := &sync.Mutex{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		numRequests++
+		n := numRequests
+		mutex.Unlock()
+
+		if n == 1 {
+			writeTestData(w, 503, "retry me")
+			return
+		}
+
+		writeTestData(w, 200, "ok")
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var attempts []Attempt
+	mutex2 := &sync.Mutex{}
+
+	reader := testGetter(t, req)
+	reader.OnAttempt(func(a Attempt) {
+		mutex2.Lock()
+		attempts = append(attempts, a)
+		mutex2.Unlock()
+	})
+
+	code, _ := reader.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", len(attempts))
+	}
+
+	if attempts[0].Num != 1 || attempts[0].StatusCode != 503 {
+		t.Errorf("Unexpected first attempt: %+v", attempts[0])
+	}
+
+	if attempts[1].Num != 2 || attempts[1].StatusCode != 200 {
+		t.Errorf("Unexpected second attempt: %+v", attempts[1])
+	}
+
+	for i, a := range attempts {
+		if a.Start.IsZero() || a.End.IsZero() || a.End.Before(a.Start) {
+			t.Errorf("Attempt %d has bad timing: %+v", i, a)
+		}
+	}
+
+	reader.Close()
+}
+
+func TestClientTrace(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeTestData(w, 200, "ok")
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotConn, gotFirstByte bool
+	reader := testGetter(t, req)
+	reader.SetClientTrace(&httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			gotConn = true
+		},
+		GotFirstResponseByte: func() {
+			gotFirstByte = true
+		},
+	})
+
+	var attempts []Attempt
+	reader.OnAttempt(func(a Attempt) {
+		attempts = append(attempts, a)
+	})
+
+	code, _ := reader.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if !gotConn || !gotFirstByte {
+		t.Errorf("Expected caller's httptrace.ClientTrace hooks to fire: gotConn=%v gotFirstByte=%v", gotConn, gotFirstByte)
+	}
+
+	if len(attempts) != 1 || attempts[0].FirstByte.IsZero() {
+		t.Errorf("Expected internal tracing to still record FirstByte: %+v", attempts)
+	}
+
+	reader.Close()
+}
+
 func writeTestData(w http.ResponseWriter, status int, body string) {
 	by := []byte(body)
 	head := w.Header()
@@ -36,6 +36,68 @@ You can pass in an *http.Client if you don't want to use http.DefaultClient.
     getter := httpretry.Getter(req)
     getter.SetClient(&http.Client{})
 
+You can attach a context.Context to cancel an in progress request, including
+any time spent sleeping between retries.
+
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.GetterWithContext(ctx, req)
+
+If the underlying resource changes between retries, the server will ignore
+the Range header and send a fresh, full response instead of the expected
+206.  By default, this triggers a transparent restart from offset 0; use
+SetOnResourceChanged to stop instead, with Read() returning
+ErrResourceChanged.
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.Getter(req)
+    getter.SetOnResourceChanged(func(g *httpretry.HttpGetter) {
+      log.Printf("resource changed, stopping download")
+    })
+
+A 429 or 503 response carrying a Retry-After header overrides the next
+backoff interval with the server-sent value.  You can cap how long it's
+willing to wait.
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.Getter(req)
+    getter.SetMaxRetryAfter(30 * time.Second)
+
+For large objects on high-latency links, ParallelGetter splits the download
+into concurrent Range requests instead of a single stream, falling back to
+the same behavior as Getter when the server doesn't support it.
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.Parallel(req)
+    defer getter.Close()
+
+    getter.SetConcurrency(8)
+    status, head := getter.Do()
+
+    io.Copy(someWriter, getter)
+
+You can receive a summary of every attempt's timing, including whether the
+connection was reused and how long it took to get the first byte, without
+writing your own httptrace.ClientTrace.
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.Getter(req)
+    getter.OnAttempt(func(a httpretry.Attempt) {
+      log.Printf("attempt %d: reused=%v ttfb=%s", a.Num, a.Reused, a.FirstByte.Sub(a.Start))
+    })
+
+You can request a gzip-encoded response and have it transparently decoded.
+A dropped connection while decoding restarts the whole object from offset 0,
+since a gzip stream can't be resumed part way through.  If decoded bytes had
+already been returned by Read(), there's no restart: Read() returns
+ErrGzipInterrupted instead.
+
+    req, _ := http.NewRequest("GET", "some/uri", nil)
+    getter := httpretry.Getter(req)
+    getter.EnableCompression(true)
+
 You can set a callback to see every response, for logging purposes.
 
     // import "github.com/peterbourgon/g2s"
@@ -0,0 +1,404 @@
+package httpretry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+)
+
+// DefaultConcurrency is the number of range parts a *ParallelGetter splits a
+// resource into when SetConcurrency() hasn't been called.
+const DefaultConcurrency = 4
+
+// DefaultMaxInFlightBytes caps how much data a *ParallelGetter will let its
+// parts read ahead of the consumer before blocking, when
+// SetMaxInFlightBytes() hasn't been called.
+const DefaultMaxInFlightBytes = 16 * 1024 * 1024
+
+// ParallelCloseCallback is called after a *ParallelGetter has closed.
+type ParallelCloseCallback func(*ParallelGetter)
+
+// A ParallelGetter fetches a resource using multiple concurrent Range
+// requests instead of a single stream, for higher throughput on large
+// objects over high-latency links.  Each part is its own *HttpGetter, so
+// dropped connections are retried with the same backoff machinery that
+// *HttpGetter uses.
+//
+// A HEAD request is issued first to learn the resource's Content-Length and
+// whether the server supports Accept-Ranges.  If it doesn't, the
+// Content-Length is unknown, or SetConcurrency(1) was used, ParallelGetter
+// falls back to the single-stream behavior of *HttpGetter.
+//
+// Like *HttpGetter, ParallelGetter implements io.ReadCloser: Do() must be
+// called before the first Read(), and Close() must be called to clean up
+// any lingering connections.  Read() drains each part fully, in order, so
+// the resulting stream and its SHA256 signature are identical to a
+// single-stream fetch of the same resource.
+type ParallelGetter struct {
+	Request       *http.Request
+	ContentLength int64
+	BytesRead     int64
+	StatusCode    int
+	Header        http.Header
+
+	client      *http.Client
+	hasher      hash.Hash
+	rcb         ResponseCallback
+	ccb         ParallelCloseCallback
+	ctx         context.Context
+	ctrace      *httptrace.ClientTrace
+	acb         AttemptCallback
+	concurrency int
+	maxInFlight int64
+
+	single  *HttpGetter
+	parts   []*parallelPart
+	current int
+	closed  bool
+}
+
+type parallelPart struct {
+	getter *HttpGetter
+	pr     *io.PipeReader
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Parallel initializes the *ParallelGetter.
+func Parallel(req *http.Request) *ParallelGetter {
+	return &ParallelGetter{Request: req}
+}
+
+// SetClient sets the HTTP Client used for the probing HEAD request and every
+// part.  If nil, http.DefaultClient is used.
+func (g *ParallelGetter) SetClient(c *http.Client) {
+	if c == nil {
+		c = http.DefaultClient
+	}
+	g.client = c
+}
+
+// SetHash sets the Hash used to calculate a signature of the content read
+// from this *ParallelGetter.  If nil, a new sha256 hash is created.
+func (g *ParallelGetter) SetHash(h hash.Hash) {
+	if h == nil {
+		h = sha256.New()
+	}
+	g.hasher = h
+}
+
+// OnResponse sets a function to be called after every attempted HTTP
+// response, across the probe and every part.
+func (g *ParallelGetter) OnResponse(f ResponseCallback) {
+	if f == nil {
+		f = rcb
+	}
+	g.rcb = f
+}
+
+// OnClose sets a function to be called after the getter has closed.
+func (g *ParallelGetter) OnClose(f ParallelCloseCallback) {
+	if f == nil {
+		f = pccb
+	}
+	g.ccb = f
+}
+
+// SetContext attaches a context.Context to this *ParallelGetter and every
+// part it spawns.  See HttpGetter.SetContext.
+func (g *ParallelGetter) SetContext(ctx context.Context) {
+	g.ctx = ctx
+}
+
+// SetClientTrace attaches a httptrace.ClientTrace to the probe and every
+// part's *HttpGetter.  See HttpGetter.SetClientTrace.
+func (g *ParallelGetter) SetClientTrace(t *httptrace.ClientTrace) {
+	g.ctrace = t
+}
+
+// OnAttempt sets a function to be called after every attempt made by the
+// probe or any part, with a summary of its timing and outcome.  See
+// HttpGetter.OnAttempt.
+func (g *ParallelGetter) OnAttempt(f AttemptCallback) {
+	if f == nil {
+		f = acb
+	}
+	g.acb = f
+}
+
+// SetConcurrency sets the number of Range parts to split the resource into.
+// n < 1 is treated as 1, which causes Do() to use the single-stream
+// behavior of *HttpGetter instead of issuing any Range requests.
+func (g *ParallelGetter) SetConcurrency(n int) {
+	if n < 1 {
+		n = 1
+	}
+	g.concurrency = n
+}
+
+// SetMaxInFlightBytes caps how much data, across all parts combined, can be
+// downloaded ahead of the consumer before parts block.  n < 1 resets it to
+// DefaultMaxInFlightBytes.
+func (g *ParallelGetter) SetMaxInFlightBytes(n int64) {
+	if n < 1 {
+		n = DefaultMaxInFlightBytes
+	}
+	g.maxInFlight = n
+}
+
+func (g *ParallelGetter) setDefaults() {
+	if g.client == nil {
+		g.SetClient(nil)
+	}
+	if g.hasher == nil {
+		g.SetHash(nil)
+	}
+	if g.rcb == nil {
+		g.OnResponse(nil)
+	}
+	if g.ccb == nil {
+		g.OnClose(nil)
+	}
+	if g.acb == nil {
+		g.OnAttempt(nil)
+	}
+	if g.concurrency == 0 {
+		g.concurrency = DefaultConcurrency
+	}
+	if g.maxInFlight == 0 {
+		g.maxInFlight = DefaultMaxInFlightBytes
+	}
+}
+
+// Do returns the status code and response header for the resource.  If the
+// resource can be split into Range parts, this comes from a HEAD probe and
+// every part is started in its own goroutine.  Otherwise, it falls back to
+// a single *HttpGetter and its behavior is identical to HttpGetter.Do().
+func (g *ParallelGetter) Do() (int, http.Header) {
+	g.setDefaults()
+
+	if g.concurrency > 1 {
+		if head, length, err := g.probe(); err == nil &&
+			head.Get(acceptHeader) == acceptValue && length > 0 {
+
+			g.ContentLength = length
+			g.StatusCode = 200
+			g.Header = head
+			g.startParts(head.Get(etagHeader), head.Get(lastModHeader))
+			return g.StatusCode, g.Header
+		}
+	}
+
+	g.single = Getter(g.Request)
+	g.single.SetClient(g.client)
+	g.single.SetHash(g.hasher)
+	g.single.OnResponse(g.rcb)
+	g.single.OnAttempt(g.acb)
+	g.single.SetClientTrace(g.ctrace)
+	if g.ctx != nil {
+		g.single.SetContext(g.ctx)
+	}
+
+	g.StatusCode, g.Header = g.single.Do()
+	g.ContentLength = g.single.ContentLength
+	return g.StatusCode, g.Header
+}
+
+// probe issues a HEAD request for g.Request's URL to learn the
+// Accept-Ranges and Content-Length headers without downloading the body.
+func (g *ParallelGetter) probe() (http.Header, int64, error) {
+	req, err := http.NewRequest("HEAD", g.Request.URL.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for k, v := range g.Request.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	if g.ctx != nil {
+		req = req.WithContext(g.ctx)
+	}
+
+	res, err := g.client.Do(req)
+	g.rcb(res, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return res.Header, 0, fmt.Errorf("Expected status code 200 from HEAD, got %d", res.StatusCode)
+	}
+
+	length, _ := strconv.ParseInt(res.Header.Get(clenHeader), 10, 0)
+	return res.Header, length, nil
+}
+
+// startParts splits [0, g.ContentLength) into g.concurrency equally-sized
+// byte ranges and starts fetching each one concurrently.
+func (g *ParallelGetter) startParts(etag, lastModified string) {
+	n := g.concurrency
+	if int64(n) > g.ContentLength {
+		n = int(g.ContentLength)
+	}
+
+	size := g.ContentLength / int64(n)
+	chunk := g.maxInFlight / int64(n)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	g.parts = make([]*parallelPart, 0, n)
+
+	parentCtx := g.ctx
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + size - 1
+		if i == n-1 {
+			end = g.ContentLength - 1
+		}
+
+		part := g.newPart(start, end, etag, lastModified)
+		ctx, cancel := context.WithCancel(parentCtx)
+		part.SetContext(ctx)
+
+		pr, pw := io.Pipe()
+		pp := &parallelPart{getter: part, pr: pr, cancel: cancel, done: make(chan struct{})}
+		g.parts = append(g.parts, pp)
+
+		go g.runPart(pp, pw, chunk)
+
+		start = end + 1
+	}
+}
+
+// newPart builds the *HttpGetter responsible for fetching [start, end] of
+// the resource.
+func (g *ParallelGetter) newPart(start, end int64, etag, lastModified string) *HttpGetter {
+	req, _ := http.NewRequest(g.Request.Method, g.Request.URL.String(), nil)
+	for k, v := range g.Request.Header {
+		req.Header[k] = append([]string(nil), v...)
+	}
+
+	part := Getter(req)
+	part.SetClient(g.client)
+	part.OnResponse(g.rcb)
+	part.OnAttempt(g.acb)
+	part.SetClientTrace(g.ctrace)
+	part.isPart = true
+	part.partRangeStart = start
+	part.partRangeEnd = end
+	part.ContentLength = end - start + 1
+	part.etag = etag
+	part.lastModified = lastModified
+
+	return part
+}
+
+// runPart drives a single part to completion and streams it into pw, in
+// chunks no larger than chunkSize, so that a slow consumer can't let any one
+// part buffer an unbounded amount of data ahead of Read().  It's the sole
+// owner of part.getter for its entire lifetime, including closing it, so
+// that Close() never touches a part's *HttpGetter concurrently with this
+// goroutine; Close() only cancels its context and closes pr to make it
+// return, then waits on done.
+func (g *ParallelGetter) runPart(part *parallelPart, pw *io.PipeWriter, chunkSize int64) {
+	defer close(part.done)
+	defer part.getter.Close()
+
+	code, _ := part.getter.Do()
+	if code != 206 {
+		pw.CloseWithError(fmt.Errorf("Expected partial content for range part, got status %d", code))
+		return
+	}
+
+	if _, err := io.CopyBuffer(pw, part.getter, make([]byte, chunkSize)); err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+
+	pw.Close()
+}
+
+// Read implements the io.Reader interface.  It drains each part fully, in
+// order, so the resulting stream is byte-identical to a single-stream fetch
+// of the same resource.  The hasher and BytesRead are only ever fed here, in
+// offset order, never from the concurrent part goroutines.
+func (g *ParallelGetter) Read(b []byte) (int, error) {
+	if g.single != nil {
+		read, err := g.single.Read(b)
+		if read > 0 {
+			g.BytesRead += int64(read)
+		}
+		return read, err
+	}
+
+	for g.current < len(g.parts) {
+		read, err := g.parts[g.current].pr.Read(b)
+		if read > 0 {
+			g.BytesRead += int64(read)
+			g.hasher.Write(b[:read])
+		}
+
+		if err == io.EOF {
+			g.current++
+			if read > 0 {
+				return read, nil
+			}
+			continue
+		}
+
+		return read, err
+	}
+
+	return 0, io.EOF
+}
+
+// Sha256 gets the hex encoded SHA 256 signature of the content that's been
+// read so far.
+func (g *ParallelGetter) Sha256() string {
+	return hex.EncodeToString(g.hasher.Sum(nil))
+}
+
+// Close cleans up any lingering HTTP connections across every part.  Each
+// part's *HttpGetter is only ever touched by its own runPart goroutine, so
+// Close() doesn't call into it directly: it cancels the part's context and
+// closes its pipe to unblock any in-flight read or write, then waits for
+// runPart to finish tearing it down.
+func (g *ParallelGetter) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+
+	var err error
+
+	if g.single != nil {
+		err = g.single.Close()
+	}
+
+	for _, p := range g.parts {
+		p.cancel()
+		p.pr.Close()
+	}
+	for _, p := range g.parts {
+		<-p.done
+	}
+
+	g.ccb(g)
+
+	return err
+}
+
+var pccb = func(g *ParallelGetter) {}
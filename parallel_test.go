@@ -0,0 +1,267 @@
+package httpretry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParallelGetter(t *testing.T) {
+	t.Parallel()
+	content := []byte("0123456789abcdef0123456789abcdef")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+		head.Set("ETag", "v1")
+
+		if r.Method == "HEAD" {
+			head.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+			return
+		}
+
+		start, end := 0, len(content)-1
+		if v := r.Header.Get("Range"); strings.HasPrefix(v, "bytes=") {
+			parts := strings.SplitN(v[6:], "-", 2)
+			start, _ = strconv.Atoi(parts[0])
+			end, _ = strconv.Atoi(parts[1])
+			head.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			head.Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(206)
+		} else {
+			head.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+		}
+
+		w.Write(content[start : end+1])
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getter := Parallel(req)
+	getter.SetConcurrency(4)
+
+	code, head := getter.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	if ctype := head.Get("Content-Type"); ctype != "text/plain" {
+		t.Errorf("Unexpected Content Type: %s", ctype)
+	}
+
+	buf := &bytes.Buffer{}
+	written, err := io.Copy(buf, getter)
+	if err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if written != int64(len(content)) {
+		t.Errorf("Wrote %d, expected %d", written, len(content))
+	}
+
+	if b := buf.String(); b != string(content) {
+		t.Errorf("Got %s", b)
+	}
+
+	expected := sha256.Sum256(content)
+	if s := getter.Sha256(); s != hex.EncodeToString(expected[:]) {
+		t.Errorf("Bad SHA256: %s", s)
+	}
+
+	getter.Close()
+}
+
+// TestParallelGetterCloseBeforeDrain pins the teardown ordering in Close():
+// each part's runPart goroutine is the sole owner of its *HttpGetter, so
+// Close() must never touch it directly while a part is still mid-flight.
+// Run with `go test -race` to catch a regression.
+func TestParallelGetterCloseBeforeDrain(t *testing.T) {
+	t.Parallel()
+	content := bytes.Repeat([]byte("x"), 4096)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Type", "text/plain")
+
+		if r.Method == "HEAD" {
+			head.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+			return
+		}
+
+		// Give the parts' goroutines time to still be mid-flight when the
+		// test calls Close() below.
+		time.Sleep(20 * time.Millisecond)
+
+		start, end := 0, len(content)-1
+		if v := r.Header.Get("Range"); strings.HasPrefix(v, "bytes=") {
+			parts := strings.SplitN(v[6:], "-", 2)
+			start, _ = strconv.Atoi(parts[0])
+			end, _ = strconv.Atoi(parts[1])
+			head.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			head.Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(206)
+		} else {
+			head.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+		}
+
+		w.Write(content[start : end+1])
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getter := Parallel(req)
+	getter.SetConcurrency(4)
+
+	code, _ := getter.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	// Close before any Read(): every part is still mid-flight in its own
+	// runPart goroutine.
+	if err := getter.Close(); err != nil {
+		t.Errorf("Close error: %s", err)
+	}
+}
+
+// TestParallelGetterPartRetriesWithoutAcceptRanges pins the fix to
+// setResponse: a part's 206 isn't required to carry Accept-Ranges on every
+// response, only the HEAD probe, so a dropped connection mid-part must
+// still retry instead of silently truncating the part.
+func TestParallelGetterPartRetriesWithoutAcceptRanges(t *testing.T) {
+	t.Parallel()
+	content := []byte("0123456789")
+
+	mutex := &sync.Mutex{}
+	seen := map[string]bool{}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Content-Type", "text/plain")
+
+		if r.Method == "HEAD" {
+			head.Set("Accept-Ranges", "bytes")
+			head.Set("Content-Length", strconv.Itoa(len(content)))
+			w.WriteHeader(200)
+			return
+		}
+
+		v := r.Header.Get("Range")
+		rangeParts := strings.SplitN(v[6:], "-", 2)
+		start, _ := strconv.Atoi(rangeParts[0])
+		end, _ := strconv.Atoi(rangeParts[1])
+		head.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+
+		mutex.Lock()
+		first := !seen[v]
+		seen[v] = true
+		mutex.Unlock()
+
+		if start == 0 && first {
+			// Part 0's first 206 omits Accept-Ranges and drops after 2 of
+			// its 5 bytes.  Without the fix, the missing header stops
+			// retries here and the part truncates instead of resuming.
+			head.Set("Content-Length", strconv.Itoa(end-start+1))
+			w.WriteHeader(206)
+			w.Write(content[start : start+2])
+			return
+		}
+
+		head.Set("Accept-Ranges", "bytes")
+		head.Set("Content-Length", strconv.Itoa(end-start+1))
+		w.WriteHeader(206)
+		w.Write(content[start : end+1])
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getter := Parallel(req)
+	getter.SetConcurrency(2)
+
+	code, _ := getter.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	buf := &bytes.Buffer{}
+	written, err := io.Copy(buf, getter)
+	if err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if written != int64(len(content)) {
+		t.Errorf("Wrote %d, expected %d", written, len(content))
+	}
+
+	if b := buf.String(); b != string(content) {
+		t.Errorf("Got %q, expected %q", b, string(content))
+	}
+
+	getter.Close()
+}
+
+func TestParallelGetterFallback(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		head := w.Header()
+		head.Set("Content-Type", "text/plain")
+		head.Set("Content-Length", "2")
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getter := Parallel(req)
+	getter.SetConcurrency(1)
+
+	code, _ := getter.Do()
+	if code != 200 {
+		t.Errorf("Unexpected status %d", code)
+	}
+
+	buf := &bytes.Buffer{}
+	written, err := io.Copy(buf, getter)
+	if err != nil {
+		t.Errorf("Copy error: %s", err)
+	}
+
+	if written != 2 {
+		t.Errorf("Wrote %d", written)
+	}
+
+	if b := buf.String(); b != "ok" {
+		t.Errorf("Got %s", b)
+	}
+
+	getter.Close()
+}